@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bonitosrv/esversion"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Searcher is the subset of the Elasticsearch client that ByDimensionApi
+// needs. It's injected at construction time (see
+// NewByDimensionApiWithSearcher) so the API can be unit-tested with a fake
+// implementation instead of requiring a live ES cluster.
+type Searcher interface {
+	Search(ctx context.Context, index, query, body string) (*http.Response, error)
+	MultiSearch(ctx context.Context, index, body string) (*http.Response, error)
+	Ping() (*http.Response, error)
+}
+
+// BatchResult is the outcome of one subrequest inside a BatchQuery call.
+// A subrequest can fail (bad metric name, ES-side error on just that
+// search) without failing the rest of the batch.
+type BatchResult struct {
+	Response *ByDimensionResponse
+	Code     int
+	Err      error
+}
+
+// BatchQuery packs every request into a single Elasticsearch `_msearch`
+// call instead of issuing one round-trip per request, which is what
+// dashboards that fetch many panels at once end up doing through Query.
+// ctx governs the whole batch: cancelling it aborts the _msearch call the
+// same way it aborts a plain Query.
+func (api *ByDimensionApi) BatchQuery(ctx context.Context, reqs []*ByDimensionRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+	if len(reqs) == 0 {
+		return results
+	}
+
+	v, err := api.ensureVersion()
+	if err != nil {
+		failBatch(results, allIndices(len(reqs)), 500, err)
+		return results
+	}
+
+	var body strings.Builder
+	valid := make([]int, 0, len(reqs))
+
+	for i, req := range reqs {
+		api.setRequestDefaults(req)
+
+		var esreq EsByDimensionReq
+		primary := &esreq.Aggs.Primary
+		primary.Terms.Field = req.Config.Primary_dimension
+
+		aggs, err := api.buildRequestAggs(req)
+		if err != nil {
+			results[i] = BatchResult{Code: 400, Err: err}
+			continue
+		}
+		primary.Aggs = *aggs
+
+		aggs, err = api.buildRequestHistogramAggs(req)
+		if err != nil {
+			results[i] = BatchResult{Code: 400, Err: err}
+			continue
+		}
+		for k, v := range *aggs {
+			primary.Aggs[k] = v
+		}
+
+		if esversion.NeedsSizeZero(v) {
+			zero := 0
+			esreq.Size = &zero
+		}
+
+		bodyLine, err := json.Marshal(&esreq)
+		if err != nil {
+			results[i] = BatchResult{Code: 500, Err: err}
+			continue
+		}
+
+		header := MapStr{"index": api.Index}
+		if v == esversion.V1 {
+			header["search_type"] = "count"
+		}
+		headerLine, err := json.Marshal(header)
+		if err != nil {
+			results[i] = BatchResult{Code: 500, Err: err}
+			continue
+		}
+
+		body.Write(headerLine)
+		body.WriteString("\n")
+		body.Write(bodyLine)
+		body.WriteString("\n")
+
+		valid = append(valid, i)
+	}
+
+	if len(valid) == 0 {
+		return results
+	}
+
+	resp, err := api.es.MultiSearch(ctx, api.Index, body.String())
+	if err != nil {
+		failBatch(results, valid, 500, err)
+		return results
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		failBatch(results, valid, 500, err)
+		return results
+	}
+
+	var answ struct {
+		Responses []struct {
+			Status       int             `json:"status"`
+			Error        json.RawMessage `json:"error"`
+			Aggregations struct {
+				Primary struct {
+					Buckets []map[string]json.RawMessage
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(respBody, &answ); err != nil {
+		failBatch(results, valid, 500, err)
+		return results
+	}
+
+	for n, i := range valid {
+		if n >= len(answ.Responses) {
+			results[i] = BatchResult{Code: 500, Err: fmt.Errorf("msearch: missing response for subrequest %d", i)}
+			continue
+		}
+
+		sub := answ.Responses[n]
+		if sub.Status != 0 && sub.Status/100 != 2 {
+			results[i] = BatchResult{Code: sub.Status, Err: fmt.Errorf("msearch: subrequest %d failed: %s", i, sub.Error)}
+			continue
+		}
+
+		response := ByDimensionResponse{Status: "ok", Primary: []PrimaryDimension{}}
+		failed := false
+		for _, bucket := range sub.Aggregations.Primary.Buckets {
+			primary, err := api.bucketToPrimary(reqs[i], bucket)
+			if err != nil {
+				results[i] = BatchResult{Code: 500, Err: err}
+				failed = true
+				break
+			}
+			response.Primary = append(response.Primary, *primary)
+		}
+		if !failed {
+			results[i] = BatchResult{Response: &response, Code: 200}
+		}
+	}
+
+	return results
+}
+
+func failBatch(results []BatchResult, indices []int, code int, err error) {
+	for _, i := range indices {
+		results[i] = BatchResult{Code: code, Err: err}
+	}
+}
+
+func allIndices(n int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
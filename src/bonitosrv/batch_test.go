@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeSearcher is a Searcher that serves canned responses instead of
+// talking to a live Elasticsearch cluster.
+type fakeSearcher struct {
+	multiSearchBody string
+	multiSearchResp string
+}
+
+func (f *fakeSearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	return nil, nil
+}
+
+func (f *fakeSearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	f.multiSearchBody = body
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(f.multiSearchResp)),
+	}, nil
+}
+
+func (f *fakeSearcher) Ping() (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"version":{"number":"2.4.0"}}`)),
+	}, nil
+}
+
+var _ = Describe("BatchQuery", func() {
+	It("should pack every request into one _msearch NDJSON body", func() {
+		fake := &fakeSearcher{multiSearchResp: `{
+			"responses": [
+				{"status": 200, "aggregations": {"primary": {"buckets": [
+					{"key": "service1", "volume": {"value": 5}}
+				]}}},
+				{"status": 500, "error": {"type": "search_phase_execution_exception"}}
+			]
+		}`}
+
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		req1 := &ByDimensionRequest{Metrics: []string{"volume"}}
+		req2 := &ByDimensionRequest{Metrics: []string{"volume"}}
+
+		results := api.BatchQuery(context.Background(), []*ByDimensionRequest{req1, req2})
+		Expect(results).To(HaveLen(2))
+
+		Expect(results[0].Err).To(BeNil())
+		Expect(results[0].Code).To(Equal(200))
+		Expect(results[0].Response.Primary[0].Name).To(Equal("service1"))
+		Expect(results[0].Response.Primary[0].Metrics["volume"]).To(BeNumerically("~", 5))
+
+		Expect(results[1].Err).To(HaveOccurred())
+		Expect(results[1].Code).To(Equal(500))
+
+		Expect(strings.Count(fake.multiSearchBody, "\n")).To(Equal(4))
+	})
+
+	It("should surface a per-request build error without calling ES", func() {
+		fake := &fakeSearcher{}
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		req := &ByDimensionRequest{Metrics: []string{"not-a-metric"}}
+		results := api.BatchQuery(context.Background(), []*ByDimensionRequest{req})
+
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Err).To(HaveOccurred())
+		Expect(results[0].Code).To(Equal(400))
+		Expect(fake.multiSearchBody).To(BeEmpty())
+	})
+})
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bonitosrv/elasticsearch"
+	"bonitosrv/esversion"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -10,14 +13,29 @@ import (
 
 // Type grouping the methods of this API end point
 type ByDimensionApi struct {
-	es    *elasticsearch.Elasticsearch
+	es    Searcher
 	Index string
+	// Retry starts out as a copy of defaultRetryPolicy (see
+	// NewByDimensionApiWithSearcher). A nil Retry also falls back to
+	// defaultRetryPolicy in retryingSearch, whereas an explicit
+	// RetryPolicy{} means zero retries, zero backoff.
+	Retry     *RetryPolicy
+	esVersion esversion.Version
 }
 
 func NewByDimensionApi(index string) *ByDimensionApi {
+	return NewByDimensionApiWithSearcher(index, elasticsearch.NewElasticsearch())
+}
+
+// NewByDimensionApiWithSearcher builds a ByDimensionApi backed by an
+// arbitrary Searcher, so tests can inject a fake instead of a live
+// Elasticsearch client.
+func NewByDimensionApiWithSearcher(index string, es Searcher) *ByDimensionApi {
+	policy := defaultRetryPolicy()
 	return &ByDimensionApi{
-		es:    elasticsearch.NewElasticsearch(),
+		es:    es,
 		Index: index,
+		Retry: &policy,
 	}
 }
 
@@ -34,6 +52,7 @@ type ByDimensionRequest struct {
 		Count_field         string
 		Percentiles         []float32
 		Histogram_points    int
+		RequestTimeout      time.Duration
 	}
 }
 
@@ -91,10 +110,40 @@ type HistogramValue struct {
 	Value float32 `json:"value"`
 }
 
+// ensureVersion detects the Elasticsearch cluster's major version on
+// first use (via a Ping, i.e. `GET /`) and caches it, since the request
+// and response shapes bonito needs to produce/consume depend on it.
+func (api *ByDimensionApi) ensureVersion() (esversion.Version, error) {
+	if api.esVersion != esversion.Unknown {
+		return api.esVersion, nil
+	}
+
+	resp, err := api.es.Ping()
+	if err != nil {
+		return esversion.Unknown, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return esversion.Unknown, err
+	}
+
+	v, err := esversion.Detect(body)
+	if err != nil {
+		return esversion.Unknown, err
+	}
+
+	api.esVersion = v
+	return v, nil
+}
+
 // EsByDimensionReq is the structure that gets marshaled to JSON
 // and is sent to Elasticsearch.
 type EsByDimensionReq struct {
-	Aggs struct {
+	Query *MapStr `json:"query,omitempty"`
+	Size  *int    `json:"size,omitempty"`
+	Aggs  struct {
 		Primary struct {
 			Terms struct {
 				Field string `json:"field"`
@@ -136,13 +185,9 @@ func (api *ByDimensionApi) buildRequestAggs(req *ByDimensionRequest) (*MapStr, e
 			}
 		case "errors_rate":
 			aggs["errors_count"] = MapStr{
-				"filter": MapStr{
-					"not": MapStr{
-						"term": MapStr{
-							req.Config.Status_field: req.Config.Status_value_ok,
-						},
-					},
-				},
+				"filter": MapStr(esversion.NotFilter(api.esVersion, map[string]interface{}{
+					req.Config.Status_field: req.Config.Status_value_ok,
+				})),
 				"aggs": MapStr{
 					"count": MapStr{
 						"sum": MapStr{
@@ -246,11 +291,11 @@ func (api *ByDimensionApi) bucketToPrimary(req *ByDimensionRequest,
 			primary.Metrics["rt_avg"] = stats.Avg
 
 		case "rt_percentiles":
-			var percentiles struct {
-				Values map[string]float32
+			values, err := esversion.PercentileValues(api.esVersion, bucket["rt_percentiles"])
+			if err != nil {
+				return nil, err
 			}
-			err = json.Unmarshal(bucket["rt_percentiles"], &percentiles)
-			for key, value := range percentiles.Values {
+			for key, value := range values {
 				primary.Metrics[fmt.Sprintf("rt_%sp", key)] = value
 			}
 
@@ -324,13 +369,88 @@ func (api *ByDimensionApi) bucketToPrimary(req *ByDimensionRequest,
 	return &primary, nil
 }
 
-func (api *ByDimensionApi) Query(req *ByDimensionRequest) (*ByDimensionResponse, int, error) {
+// doSearch marshals esreq, sends it to Elasticsearch and returns the raw
+// response body. Every query shape built on EsByDimensionReq (plain
+// by-dimension, Prometheus selectors, ...) goes through it; other shapes
+// call doSearchRaw directly.
+func (api *ByDimensionApi) doSearch(ctx context.Context, esreq *EsByDimensionReq) ([]byte, int, error) {
+	v, err := api.ensureVersion()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	if esversion.NeedsSizeZero(v) && esreq.Size == nil {
+		zero := 0
+		esreq.Size = &zero
+	}
+
+	objreq, err := json.Marshal(esreq)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	//fmt.Println("Objreq=", string(objreq))
+
+	return api.doSearchRaw(ctx, string(objreq))
+}
+
+// doSearchRaw sends an already-marshaled search body to Elasticsearch and
+// returns the raw response body. It's the lowest-level entry point for
+// talking to the ES search endpoint, shared by every query shape that
+// can't use the plain EsByDimensionReq (e.g. StreamQuery's composite
+// aggregation). ctx is threaded all the way down to the HTTP request, so
+// a caller's cancellation or deadline aborts the in-flight ES search
+// instead of leaving it to run to completion.
+func (api *ByDimensionApi) doSearchRaw(ctx context.Context, body string) ([]byte, int, error) {
+	v, err := api.ensureVersion()
+	if err != nil {
+		return nil, 500, err
+	}
+
+	resp, err := api.retryingSearch(ctx, api.Index, esversion.SearchQueryString(v), body)
+	if err != nil {
+		return nil, translateErrCode(err), err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, translateErrCode(err), err
+	}
+
+	if resp.StatusCode > 299 {
+		return nil, 500, fmt.Errorf("Elasticsearch returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return respBody, 200, nil
+}
+
+// translateErrCode turns a context deadline into the HTTP code a slow ES
+// query should surface as, rather than the generic 500 used for every
+// other kind of failure.
+func translateErrCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 504
+	}
+	return 500
+}
+
+func (api *ByDimensionApi) Query(ctx context.Context, req *ByDimensionRequest) (*ByDimensionResponse, int, error) {
 
 	var esreq EsByDimensionReq
-	es := elasticsearch.NewElasticsearch()
 
 	api.setRequestDefaults(req)
 
+	if req.Config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Config.RequestTimeout)
+		defer cancel()
+	}
+
+	if _, err := api.ensureVersion(); err != nil {
+		return nil, 500, err
+	}
+
 	primary := &esreq.Aggs.Primary
 	primary.Terms.Field = req.Config.Primary_dimension
 
@@ -353,23 +473,9 @@ func (api *ByDimensionApi) Query(req *ByDimensionRequest) (*ByDimensionResponse,
 	// up to here we assume there are client errors, from here on
 	// it's on us.
 
-	objreq, err := json.Marshal(&esreq)
-	if err != nil {
-		return nil, 500, err
-	}
-
-	//fmt.Println("Objreq=", string(objreq))
-
-	resp, err := es.Search(api.Index, "?search_type=count",
-		string(objreq))
+	body, code, err := api.doSearch(ctx, &esreq)
 	if err != nil {
-		return nil, 500, err
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, 500, err
+		return nil, code, err
 	}
 
 	var answ struct {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -75,7 +76,7 @@ var _ = Describe("ByDimension API", func() {
 				"rt_percentiles", "secondary_count", "errors_rate"}
 			req.Config.Percentiles = []float32{50, 99.995}
 
-			resp, code, err := api.Query(&req)
+			resp, code, err := api.Query(context.Background(), &req)
 			Expect(err).To(BeNil())
 			Expect(code).To(Equal(200))
 			Expect(len(resp.Primary)).To(Equal(2))
@@ -114,7 +115,7 @@ var _ = Describe("ByDimension API", func() {
 			var req ByDimensionRequest
 			req.Metrics = []string{"errors_rate"}
 
-			resp, _, err := api.Query(&req)
+			resp, _, err := api.Query(context.Background(), &req)
 			Expect(err).To(BeNil())
 			Expect(len(resp.Primary)).To(Equal(2))
 
@@ -133,7 +134,7 @@ var _ = Describe("ByDimension API", func() {
 			req.Metrics = []string{"errors_rate"}
 			req.Config.Status_value_ok = "nothing"
 
-			resp, _, err := api.Query(&req)
+			resp, _, err := api.Query(context.Background(), &req)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(len(resp.Primary)).To(Equal(2))
 
@@ -151,7 +152,7 @@ var _ = Describe("ByDimension API", func() {
 		It("should return error when the metric is not defined", func() {
 			var req ByDimensionRequest
 			req.Metrics = []string{"something"}
-			_, code, err := api.Query(&req)
+			_, code, err := api.Query(context.Background(), &req)
 			Expect(err).To(HaveOccurred())
 			Expect(code).To(Equal(400))
 		})
@@ -165,7 +166,7 @@ var _ = Describe("ByDimension API", func() {
 			req.Config.Histogram_points = 2
 			req.HistogramMetrics = []string{"volume"}
 
-			resp, _, err := api.Query(&req)
+			resp, _, err := api.Query(context.Background(), &req)
 			Expect(err).NotTo(HaveOccurred())
 
 			services := map[string]PrimaryDimension{}
@@ -185,7 +186,7 @@ var _ = Describe("ByDimension API", func() {
 			var req ByDimensionRequest
 			req.Metrics = []string{"volume"}
 
-			_, code, err := api.Query(&req)
+			_, code, err := api.Query(context.Background(), &req)
 			Expect(err).To(HaveOccurred())
 			Expect(code).To(Equal(500))
 		})
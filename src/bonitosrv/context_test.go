@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// hangingSearcher blocks until ctx is done, so Query's deadline handling
+// can be exercised without a live ES.
+type hangingSearcher struct{}
+
+func (h *hangingSearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+func (h *hangingSearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	return nil, nil
+}
+
+func (h *hangingSearcher) Ping() (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"version":{"number":"2.4.0"}}`)),
+	}, nil
+}
+
+var _ = Describe("context propagation", func() {
+	It("should surface a RequestTimeout as a 504, not a 500", func() {
+		api := NewByDimensionApiWithSearcher("unittest-index", &hangingSearcher{})
+		api.Retry = &RetryPolicy{MaxRetries: 0, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+		var req ByDimensionRequest
+		req.Metrics = []string{"volume"}
+		req.Config.RequestTimeout = 10 * time.Millisecond
+
+		_, code, err := api.Query(context.Background(), &req)
+		Expect(err).To(HaveOccurred())
+		Expect(code).To(Equal(504))
+	})
+
+	It("should abort promptly with a 504 when the caller's own deadline fires", func() {
+		api := NewByDimensionApiWithSearcher("unittest-index", &hangingSearcher{})
+		api.Retry = &RetryPolicy{MaxRetries: 0, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		var req ByDimensionRequest
+		req.Metrics = []string{"volume"}
+
+		_, code, err := api.Query(ctx, &req)
+		Expect(err).To(HaveOccurred())
+		Expect(code).To(Equal(504))
+	})
+})
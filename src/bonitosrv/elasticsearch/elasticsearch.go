@@ -0,0 +1,125 @@
+// Package elasticsearch is the thin HTTP client bonitosrv talks to a real
+// Elasticsearch cluster through. It only implements the handful of
+// endpoints bonitosrv actually needs (search, multi-search, ping, and the
+// bits of index management the test suite uses to set up its fixtures).
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Elasticsearch is a minimal client for a single Elasticsearch cluster,
+// addressed by URL.
+type Elasticsearch struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewElasticsearch builds a client pointed at the cluster named by the
+// ES_URL environment variable, defaulting to a local single-node cluster.
+func NewElasticsearch() *Elasticsearch {
+	url := os.Getenv("ES_URL")
+	if len(url) == 0 {
+		url = "http://localhost:9200"
+	}
+
+	return &Elasticsearch{
+		URL:    url,
+		Client: http.DefaultClient,
+	}
+}
+
+// Search issues a `_search` request against index, with query as the raw ES
+// query-string (e.g. "?search_type=count") and body as the JSON request
+// body. ctx is wired in via http.NewRequestWithContext, so a caller's
+// cancellation or deadline aborts the in-flight HTTP round trip instead of
+// leaving it to run to completion.
+func (es *Elasticsearch) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s/_search%s", es.URL, index, query)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return es.Client.Do(req)
+}
+
+// MultiSearch issues a `_msearch` request: body is the NDJSON of
+// alternating header/query lines the _msearch endpoint expects. ctx is
+// wired in via http.NewRequestWithContext, same as Search.
+func (es *Elasticsearch) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s/_msearch", es.URL, index)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	return es.Client.Do(req)
+}
+
+// Ping issues a `GET /`, which on every Elasticsearch version returns a
+// small JSON document including the cluster's version number.
+func (es *Elasticsearch) Ping() (*http.Response, error) {
+	return es.Client.Get(es.URL + "/")
+}
+
+// DeleteIndex deletes index, ignoring the case where it doesn't exist.
+func (es *Elasticsearch) DeleteIndex(index string) (*http.Response, error) {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s", es.URL, index), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return es.Client.Do(req)
+}
+
+// Refresh makes every document indexed so far in index visible to search,
+// which test fixtures need since Elasticsearch indexes asynchronously.
+func (es *Elasticsearch) Refresh(index string) (*http.Response, error) {
+	return es.Client.Post(fmt.Sprintf("%s/%s/_refresh", es.URL, index), "application/json", nil)
+}
+
+// Time is a time.Time that marshals as RFC3339Nano and parses only the
+// millisecond-precision UTC form used in documents and aggregation
+// responses (key_as_string), e.g. "2015-01-02T15:04:05.000Z"; see TimeParse.
+type Time time.Time
+
+func (t Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).Format(time.RFC3339Nano))
+}
+
+func (t *Time) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := TimeParse(s)
+	if err != nil {
+		return err
+	}
+
+	*t = parsed
+	return nil
+}
+
+// TimeParse parses an Elasticsearch date string, e.g.
+// "2015-01-02T15:04:05.000Z", into a Time.
+func TimeParse(s string) (Time, error) {
+	parsed, err := time.Parse("2006-01-02T15:04:05.000Z", s)
+	if err != nil {
+		return Time{}, err
+	}
+
+	return Time(parsed), nil
+}
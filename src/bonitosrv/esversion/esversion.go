@@ -0,0 +1,132 @@
+// Package esversion isolates the Elasticsearch response/request shape
+// differences that show up across major versions, so the rest of bonitosrv
+// doesn't have to special-case them inline.
+package esversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version identifies the major version of the Elasticsearch cluster
+// bonito is talking to.
+type Version int
+
+const (
+	Unknown Version = iota
+	V1              // 1.x/2.x: search_type=count, `not` filters, percentiles as a string-keyed map
+	V5
+	V6
+	V7
+)
+
+// Detect parses the major version number out of the body of a `GET /`
+// call against the cluster, e.g. {"version": {"number": "6.8.1"}}.
+func Detect(body []byte) (Version, error) {
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return Unknown, err
+	}
+
+	major := strings.SplitN(info.Version.Number, ".", 2)[0]
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return Unknown, fmt.Errorf("esversion: unparseable version number '%s'", info.Version.Number)
+	}
+
+	switch {
+	case n <= 2:
+		return V1, nil
+	case n == 5:
+		return V5, nil
+	case n == 6:
+		return V6, nil
+	case n >= 7:
+		return V7, nil
+	default:
+		return Unknown, fmt.Errorf("esversion: unsupported major version %d", n)
+	}
+}
+
+// SearchQueryString returns the query string to append to a search URL
+// that requests an aggregation-only response. 1.x/2.x use
+// `search_type=count`; 5.x removed it in favor of `size: 0` in the
+// request body (see NeedsSizeZero).
+func SearchQueryString(v Version) string {
+	if v == V1 {
+		return "?search_type=count"
+	}
+	return ""
+}
+
+// NeedsSizeZero reports whether the request body must carry `"size": 0`
+// to get an aggregation-only response, which replaced search_type=count
+// from 5.x onward.
+func NeedsSizeZero(v Version) bool {
+	return v != V1
+}
+
+// NotFilter returns the ES query fragment equivalent to "NOT term". 1.x/2.x
+// expose it as a top-level `not` filter; 5.x dropped `filtered`/`not` in
+// favor of `bool.must_not`.
+func NotFilter(v Version, term map[string]interface{}) map[string]interface{} {
+	if v == V1 {
+		return map[string]interface{}{
+			"not": map[string]interface{}{
+				"term": term,
+			},
+		}
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{
+				"term": term,
+			},
+		},
+	}
+}
+
+// SupportsComposite reports whether the cluster's composite aggregation,
+// which StreamQuery relies on for after_key pagination, is available.
+// Composite aggregations shipped in 5.1 and are assumed present on any
+// 5.x+ cluster; 1.x/2.x never had them.
+func SupportsComposite(v Version) bool {
+	return v != Unknown && v != V1
+}
+
+// PercentileValues normalizes a percentiles aggregation response into a
+// key->value map regardless of which ES version produced it: 1.x/2.x
+// return a string-keyed map, 5.x onward an array of {key, value} objects.
+func PercentileValues(v Version, raw json.RawMessage) (map[string]float32, error) {
+	if v == V1 {
+		var percentiles struct {
+			Values map[string]float32
+		}
+		if err := json.Unmarshal(raw, &percentiles); err != nil {
+			return nil, err
+		}
+		return percentiles.Values, nil
+	}
+
+	var percentiles struct {
+		Values []struct {
+			Key   string  `json:"key"`
+			Value float32 `json:"value"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(raw, &percentiles); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float32, len(percentiles.Values))
+	for _, p := range percentiles.Values {
+		values[p.Key] = p.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,67 @@
+package esversion
+
+import "testing"
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		number string
+		want   Version
+	}{
+		{"1.7.3", V1},
+		{"2.4.0", V1},
+		{"5.6.16", V5},
+		{"6.8.1", V6},
+		{"7.10.2", V7},
+	}
+
+	for _, c := range cases {
+		body := []byte(`{"version":{"number":"` + c.number + `"}}`)
+		got, err := Detect(body)
+		if err != nil {
+			t.Fatalf("Detect(%s): unexpected error: %v", c.number, err)
+		}
+		if got != c.want {
+			t.Errorf("Detect(%s) = %v, want %v", c.number, got, c.want)
+		}
+	}
+}
+
+func TestPercentileValuesV1(t *testing.T) {
+	raw := []byte(`{"values":{"50.0":100,"99.0":200}}`)
+	values, err := PercentileValues(V1, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["50.0"] != 100 || values["99.0"] != 200 {
+		t.Errorf("unexpected values: %+v", values)
+	}
+}
+
+func TestPercentileValuesV7(t *testing.T) {
+	raw := []byte(`{"values":[{"key":"50.0","value":100},{"key":"99.0","value":200}]}`)
+	values, err := PercentileValues(V7, raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["50.0"] != 100 || values["99.0"] != 200 {
+		t.Errorf("unexpected values: %+v", values)
+	}
+}
+
+func TestNotFilter(t *testing.T) {
+	term := map[string]interface{}{"status": "ok"}
+
+	v1 := NotFilter(V1, term)
+	if _, ok := v1["not"]; !ok {
+		t.Errorf("expected a top-level 'not' filter for V1, got %+v", v1)
+	}
+
+	v6 := NotFilter(V6, term)
+	boolQuery, ok := v6["bool"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a 'bool' filter for V6, got %+v", v6)
+	}
+	if _, ok := boolQuery["must_not"]; !ok {
+		t.Errorf("expected 'bool.must_not', got %+v", boolQuery)
+	}
+}
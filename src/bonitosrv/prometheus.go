@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"bonitosrv/elasticsearch"
+)
+
+// This file adds a Prometheus HTTP API v1-inspired query surface on top of
+// ByDimensionApi, so that Grafana (or any other Prometheus-compatible
+// client) can scrape bonito directly instead of wiring up one histogram
+// metric at a time.
+//
+// `expr` is a simple metric selector, e.g. `rt_avg{service=~"foo.*"}` or
+// `errors_rate{host="h1"}`: a metric name as understood by buildRequestAggs,
+// optionally followed by `{label=value, label=~regex}` matchers.
+
+// PromMatrixResponse is the envelope returned by QueryRange and QueryInstant,
+// mirroring the shape of a Prometheus `/api/v1/query` or `/api/v1/query_range`
+// response.
+type PromMatrixResponse struct {
+	Status string         `json:"status"`
+	Data   PromMatrixData `json:"data"`
+}
+
+type PromMatrixData struct {
+	ResultType string       `json:"resultType"`
+	Result     []PromSeries `json:"result"`
+}
+
+// PromSeries is a single labeled series. Values is populated for range
+// queries, Value for instant queries, matching Prometheus' own API.
+type PromSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values,omitempty"`
+	Value  [2]interface{}    `json:"value,omitempty"`
+}
+
+var promSelectorRe = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s*(?:\{(.*)\})?$`)
+var promMatcherRe = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|=)\s*"([^"]*)"`)
+
+type promLabelMatcher struct {
+	Label string
+	Value string
+	Regex bool
+}
+
+// parsePromSelector splits a selector like `rt_avg{service=~"foo.*"}` into
+// the metric name and its label matchers.
+func parsePromSelector(expr string) (string, []promLabelMatcher, error) {
+	m := promSelectorRe.FindStringSubmatch(strings.TrimSpace(expr))
+	if m == nil {
+		return "", nil, fmt.Errorf("invalid metric selector '%s'", expr)
+	}
+
+	metric := m[1]
+	var matchers []promLabelMatcher
+	if len(m[2]) > 0 {
+		for _, part := range promMatcherRe.FindAllStringSubmatch(m[2], -1) {
+			matchers = append(matchers, promLabelMatcher{
+				Label: part[1],
+				Regex: part[2] == "=~",
+				Value: part[3],
+			})
+		}
+	}
+
+	return metric, matchers, nil
+}
+
+// buildLabelFilters translates label matchers into Elasticsearch term
+// (exact match) or regexp filters.
+func buildLabelFilters(matchers []promLabelMatcher) []MapStr {
+	filters := make([]MapStr, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Regex {
+			filters = append(filters, MapStr{
+				"regexp": MapStr{m.Label: m.Value},
+			})
+		} else {
+			filters = append(filters, MapStr{
+				"term": MapStr{m.Label: m.Value},
+			})
+		}
+	}
+	return filters
+}
+
+func buildTimeRangeFilter(tr *Timerange) MapStr {
+	return MapStr{
+		"range": MapStr{
+			"timestamp": MapStr{
+				"gte": time.Time(tr.From).Format(time.RFC3339Nano),
+				"lte": time.Time(tr.To).Format(time.RFC3339Nano),
+			},
+		},
+	}
+}
+
+// extractScalarMetric pulls a single numeric value for metric out of an ES
+// aggregation bucket, using the same sub-agg names as buildRequestAggs.
+// Percentile metrics aren't supported here since a single selector would
+// otherwise expand into several series.
+func extractScalarMetric(metric string, bucket map[string]json.RawMessage) (float32, error) {
+	switch metric {
+	case "volume":
+		var v struct{ Value float32 }
+		if err := json.Unmarshal(bucket["volume"], &v); err != nil {
+			return 0, err
+		}
+		return v.Value, nil
+
+	case "rt_max", "rt_avg":
+		var stats struct{ Max, Avg float32 }
+		if err := json.Unmarshal(bucket["rt_stats"], &stats); err != nil {
+			return 0, err
+		}
+		if metric == "rt_max" {
+			return stats.Max, nil
+		}
+		return stats.Avg, nil
+
+	case "secondary_count":
+		var v struct{ Value float32 }
+		if err := json.Unmarshal(bucket["secondary_card"], &v); err != nil {
+			return 0, err
+		}
+		return v.Value, nil
+
+	case "errors_rate":
+		var errorsCount struct {
+			Count struct{ Value float32 }
+		}
+		var volume struct{ Value float32 }
+		if err := json.Unmarshal(bucket["errors_count"], &errorsCount); err != nil {
+			return 0, err
+		}
+		if err := json.Unmarshal(bucket["volume"], &volume); err != nil {
+			return 0, err
+		}
+		return errorsCount.Count.Value / volume.Value, nil
+
+	default:
+		return 0, fmt.Errorf("metric '%s' cannot be expressed as a single time series value", metric)
+	}
+}
+
+// QueryRange implements a Prometheus `/api/v1/query_range`-like query:
+// `expr` is evaluated between start and end, emitting one point roughly
+// every step for each PrimaryDimension as a labeled series.
+func (api *ByDimensionApi) QueryRange(ctx context.Context, expr string, start, end time.Time, step time.Duration) (*PromMatrixResponse, int, error) {
+	metric, matchers, err := parsePromSelector(expr)
+	if err != nil {
+		return nil, 400, err
+	}
+
+	if step <= 0 {
+		return nil, 400, fmt.Errorf("step must be positive, got %s", step)
+	}
+
+	req := &ByDimensionRequest{}
+	req.Timerange.From = JsTime(start)
+	req.Timerange.To = JsTime(end)
+	api.setRequestDefaults(req)
+
+	if _, err := api.ensureVersion(); err != nil {
+		return nil, 500, err
+	}
+
+	points := int(end.Sub(start) / step)
+	if points < 1 {
+		points = 1
+	}
+	req.Config.Histogram_points = points
+	req.Metrics = []string{metric}
+
+	var esreq EsByDimensionReq
+
+	primary := &esreq.Aggs.Primary
+	primary.Terms.Field = req.Config.Primary_dimension
+
+	metricAggs, err := api.buildRequestAggs(req)
+	if err != nil {
+		return nil, 400, err
+	}
+
+	interval := computeHistogramInterval(&req.Timerange, req.Config.Histogram_points)
+	histKey := metric + "_hist"
+	primary.Aggs = MapStr{
+		histKey: MapStr{
+			"date_histogram": MapStr{
+				"field":    "timestamp",
+				"interval": interval,
+			},
+			"aggs": *metricAggs,
+		},
+	}
+
+	filters := append(buildLabelFilters(matchers), buildTimeRangeFilter(&req.Timerange))
+	esreq.Query = &MapStr{"bool": MapStr{"filter": filters}}
+
+	body, code, err := api.doSearch(ctx, &esreq)
+	if err != nil {
+		return nil, code, err
+	}
+
+	var answ struct {
+		Aggregations struct {
+			Primary struct {
+				Buckets []map[string]json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &answ); err != nil {
+		return nil, 500, err
+	}
+
+	data := PromMatrixData{ResultType: "matrix"}
+	for _, bucket := range answ.Aggregations.Primary.Buckets {
+		var name string
+		if err := json.Unmarshal(bucket["key"], &name); err != nil {
+			return nil, 500, err
+		}
+
+		var hist struct {
+			Buckets []map[string]json.RawMessage
+		}
+		if err := json.Unmarshal(bucket[histKey], &hist); err != nil {
+			return nil, 500, err
+		}
+
+		series := PromSeries{
+			Metric: map[string]string{req.Config.Primary_dimension: name},
+		}
+		for _, tsBucket := range hist.Buckets {
+			var ts elasticsearch.Time
+			if err := json.Unmarshal(tsBucket["key_as_string"], &ts); err != nil {
+				return nil, 500, err
+			}
+			value, err := extractScalarMetric(metric, tsBucket)
+			if err != nil {
+				return nil, 500, err
+			}
+			series.Values = append(series.Values, [2]interface{}{
+				float64(time.Time(ts).Unix()), fmt.Sprintf("%v", value),
+			})
+		}
+
+		data.Result = append(data.Result, series)
+	}
+
+	return &PromMatrixResponse{Status: "success", Data: data}, 200, nil
+}
+
+// QueryInstant implements a Prometheus `/api/v1/query`-like query: `expr`
+// is evaluated as of ts, looking back over a short window to cover the
+// usual reporting interval.
+func (api *ByDimensionApi) QueryInstant(ctx context.Context, expr string, ts time.Time) (*PromMatrixResponse, int, error) {
+	metric, matchers, err := parsePromSelector(expr)
+	if err != nil {
+		return nil, 400, err
+	}
+
+	req := &ByDimensionRequest{}
+	req.Timerange.From = JsTime(ts.Add(-5 * time.Minute))
+	req.Timerange.To = JsTime(ts)
+	api.setRequestDefaults(req)
+	req.Metrics = []string{metric}
+
+	if _, err := api.ensureVersion(); err != nil {
+		return nil, 500, err
+	}
+
+	var esreq EsByDimensionReq
+
+	primary := &esreq.Aggs.Primary
+	primary.Terms.Field = req.Config.Primary_dimension
+
+	metricAggs, err := api.buildRequestAggs(req)
+	if err != nil {
+		return nil, 400, err
+	}
+	primary.Aggs = *metricAggs
+
+	filters := append(buildLabelFilters(matchers), buildTimeRangeFilter(&req.Timerange))
+	esreq.Query = &MapStr{"bool": MapStr{"filter": filters}}
+
+	body, code, err := api.doSearch(ctx, &esreq)
+	if err != nil {
+		return nil, code, err
+	}
+
+	var answ struct {
+		Aggregations struct {
+			Primary struct {
+				Buckets []map[string]json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &answ); err != nil {
+		return nil, 500, err
+	}
+
+	data := PromMatrixData{ResultType: "vector"}
+	for _, bucket := range answ.Aggregations.Primary.Buckets {
+		var name string
+		if err := json.Unmarshal(bucket["key"], &name); err != nil {
+			return nil, 500, err
+		}
+
+		value, err := extractScalarMetric(metric, bucket)
+		if err != nil {
+			return nil, 500, err
+		}
+
+		data.Result = append(data.Result, PromSeries{
+			Metric: map[string]string{req.Config.Primary_dimension: name},
+			Value:  [2]interface{}{float64(ts.Unix()), fmt.Sprintf("%v", value)},
+		})
+	}
+
+	return &PromMatrixResponse{Status: "success", Data: data}, 200, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fixedResponseSearcher always answers Search with a canned response body,
+// recording the last request so tests can assert on the query it was asked
+// to run, without needing a live ES.
+type fixedResponseSearcher struct {
+	resp     string
+	lastBody string
+}
+
+func (f *fixedResponseSearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	f.lastBody = body
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(f.resp)),
+	}, nil
+}
+
+func (f *fixedResponseSearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	return nil, nil
+}
+
+func (f *fixedResponseSearcher) Ping() (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"version":{"number":"6.8.1"}}`)),
+	}, nil
+}
+
+var _ = Describe("Prometheus selector parsing", func() {
+	It("should parse a bare metric name", func() {
+		metric, matchers, err := parsePromSelector("rt_avg")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metric).To(Equal("rt_avg"))
+		Expect(matchers).To(BeEmpty())
+	})
+
+	It("should parse term and regex matchers", func() {
+		metric, matchers, err := parsePromSelector(`errors_rate{service=~"foo.*", host="h1"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metric).To(Equal("errors_rate"))
+		Expect(matchers).To(HaveLen(2))
+		Expect(matchers[0]).To(Equal(promLabelMatcher{Label: "service", Value: "foo.*", Regex: true}))
+		Expect(matchers[1]).To(Equal(promLabelMatcher{Label: "host", Value: "h1", Regex: false}))
+	})
+
+	It("should reject a malformed selector", func() {
+		_, _, err := parsePromSelector("not a selector{")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("QueryRange", func() {
+	It("should return a matrix series per primary dimension, with a term filter for the label matcher", func() {
+		fake := &fixedResponseSearcher{resp: `{
+			"aggregations": {
+				"primary": {
+					"buckets": [{
+						"key": "service1",
+						"volume_hist": {
+							"buckets": [
+								{"key_as_string": "2015-01-02T15:00:00.000Z", "volume": {"value": 5}},
+								{"key_as_string": "2015-01-02T15:01:00.000Z", "volume": {"value": 7}}
+							]
+						}
+					}]
+				}
+			}
+		}`}
+
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		start, _ := time.Parse(time.RFC3339, "2015-01-02T15:00:00Z")
+		end, _ := time.Parse(time.RFC3339, "2015-01-02T15:02:00Z")
+
+		resp, code, err := api.QueryRange(context.Background(), `volume{host="h1"}`, start, end, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(code).To(Equal(200))
+
+		Expect(resp.Status).To(Equal("success"))
+		Expect(resp.Data.ResultType).To(Equal("matrix"))
+		Expect(resp.Data.Result).To(HaveLen(1))
+
+		series := resp.Data.Result[0]
+		Expect(series.Metric["service"]).To(Equal("service1"))
+		Expect(series.Values).To(HaveLen(2))
+		Expect(series.Values[0][1]).To(Equal("5"))
+		Expect(series.Values[1][1]).To(Equal("7"))
+
+		Expect(fake.lastBody).To(ContainSubstring(`"term":{"host":"h1"}`))
+	})
+
+	It("should reject a zero or negative step instead of dividing by it", func() {
+		fake := &fixedResponseSearcher{}
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		start, _ := time.Parse(time.RFC3339, "2015-01-02T15:00:00Z")
+		end, _ := time.Parse(time.RFC3339, "2015-01-02T15:02:00Z")
+
+		_, code, err := api.QueryRange(context.Background(), "volume", start, end, 0)
+		Expect(err).To(HaveOccurred())
+		Expect(code).To(Equal(400))
+		Expect(fake.lastBody).To(BeEmpty())
+
+		_, code, err = api.QueryRange(context.Background(), "volume", start, end, -time.Second)
+		Expect(err).To(HaveOccurred())
+		Expect(code).To(Equal(400))
+	})
+})
+
+var _ = Describe("QueryInstant", func() {
+	It("should return a vector series per primary dimension", func() {
+		fake := &fixedResponseSearcher{resp: `{
+			"aggregations": {
+				"primary": {
+					"buckets": [{"key": "service1", "volume": {"value": 9}}]
+				}
+			}
+		}`}
+
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		ts, _ := time.Parse(time.RFC3339, "2015-01-02T15:00:00Z")
+
+		resp, code, err := api.QueryInstant(context.Background(), "volume", ts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(code).To(Equal(200))
+
+		Expect(resp.Data.ResultType).To(Equal("vector"))
+		Expect(resp.Data.Result).To(HaveLen(1))
+		Expect(resp.Data.Result[0].Metric["service"]).To(Equal("service1"))
+		Expect(resp.Data.Result[0].Value[1]).To(Equal("9"))
+	})
+
+	It("should reject an unknown metric", func() {
+		fake := &fixedResponseSearcher{}
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		ts, _ := time.Parse(time.RFC3339, "2015-01-02T15:00:00Z")
+
+		_, code, err := api.QueryInstant(context.Background(), "not_a_metric", ts)
+		Expect(err).To(HaveOccurred())
+		Expect(code).To(Equal(400))
+		Expect(strings.TrimSpace(fake.lastBody)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how ByDimensionApi retries a failed Elasticsearch
+// call: exponential backoff with decorrelated jitter, as used by mature ES
+// clients, so a transient cluster hiccup turns into a successful query
+// instead of a 500.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+	}
+}
+
+// isRetryable reports whether a Search attempt is worth retrying: 429s,
+// 5xxs and connection errors are, the 4xx client errors we already
+// surface as code 400 are not.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// nextBackoff computes the sleep for the next attempt using decorrelated
+// jitter: sleep = min(max, random_between(initial, prev*3)).
+func nextBackoff(initial, prev, max time.Duration) time.Duration {
+	upper := prev * 3
+	if upper < initial {
+		upper = initial
+	}
+
+	sleep := initial + time.Duration(rand.Int63n(int64(upper-initial)+1))
+	if sleep > max {
+		sleep = max
+	}
+	return sleep
+}
+
+// retryingSearch wraps api.es.Search with api.Retry's backoff policy.
+// Every wait, including the one before the first retry, goes through
+// nextBackoff so it's randomized rather than a raw InitialBackoff.
+// ctx is checked after every attempt and during the backoff sleep, so the
+// loop stops as soon as ctx is done and returns ctx.Err(). An attempt is
+// still made when ctx is already done on entry.
+func (api *ByDimensionApi) retryingSearch(ctx context.Context, index, query, body string) (*http.Response, error) {
+	policy := defaultRetryPolicy()
+	if api.Retry != nil {
+		policy = *api.Retry
+	}
+
+	sleep := policy.InitialBackoff
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		resp, err = api.es.Search(ctx, index, query, body)
+		if ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+		if !isRetryable(resp, err) || attempt >= policy.MaxRetries {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		sleep = nextBackoff(policy.InitialBackoff, sleep, policy.MaxBackoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleep):
+		}
+	}
+}
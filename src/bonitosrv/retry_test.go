@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// flakySearcher fails the first `failures` Search calls with a 503, then
+// succeeds, so retryingSearch can be exercised without a live ES.
+type flakySearcher struct {
+	failures int
+	calls    int
+}
+
+func (f *flakySearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return &http.Response{
+			StatusCode: 503,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("{}")),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"aggregations":{"primary":{"buckets":[]}}}`)),
+	}, nil
+}
+
+func (f *flakySearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	return nil, nil
+}
+func (f *flakySearcher) Ping() (*http.Response, error) { return nil, nil }
+
+type brokenSearcher struct{ calls int }
+
+func (b *brokenSearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	b.calls++
+	return nil, fmt.Errorf("connection refused")
+}
+func (b *brokenSearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	return nil, nil
+}
+func (b *brokenSearcher) Ping() (*http.Response, error) { return nil, nil }
+
+// slowSearcher blocks until ctx is done, so retryingSearch's cancellation
+// handling can be exercised without a live ES.
+type slowSearcher struct{ calls int }
+
+func (s *slowSearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	s.calls++
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+func (s *slowSearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	return nil, nil
+}
+func (s *slowSearcher) Ping() (*http.Response, error) { return nil, nil }
+
+var _ = Describe("retrying ES searches", func() {
+	It("should classify 429s, 5xxs and connection errors as retryable", func() {
+		Expect(isRetryable(&http.Response{StatusCode: 429}, nil)).To(BeTrue())
+		Expect(isRetryable(&http.Response{StatusCode: 503}, nil)).To(BeTrue())
+		Expect(isRetryable(nil, fmt.Errorf("connection refused"))).To(BeTrue())
+		Expect(isRetryable(&http.Response{StatusCode: 400}, nil)).To(BeFalse())
+		Expect(isRetryable(&http.Response{StatusCode: 200}, nil)).To(BeFalse())
+	})
+
+	It("should keep the backoff within [initial, max]", func() {
+		sleep := 10 * time.Millisecond
+		for i := 0; i < 20; i++ {
+			sleep = nextBackoff(10*time.Millisecond, sleep, 200*time.Millisecond)
+			Expect(sleep).To(BeNumerically(">=", 10*time.Millisecond))
+			Expect(sleep).To(BeNumerically("<=", 200*time.Millisecond))
+		}
+	})
+
+	It("should retry a flaky search until it succeeds", func() {
+		fake := &flakySearcher{failures: 2}
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+		api.Retry = &RetryPolicy{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+		resp, err := api.retryingSearch(context.Background(), api.Index, "?search_type=count", "{}")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(fake.calls).To(Equal(3))
+	})
+
+	It("should honor an explicit zero-value policy instead of falling back to the default", func() {
+		broken := &brokenSearcher{}
+		api := NewByDimensionApiWithSearcher("unittest-index", broken)
+		api.Retry = &RetryPolicy{}
+
+		_, err := api.retryingSearch(context.Background(), api.Index, "?search_type=count", "{}")
+		Expect(err).To(HaveOccurred())
+		Expect(broken.calls).To(Equal(1)) // no retries, not the default's 3
+	})
+
+	It("should give up after MaxRetries and return the last error", func() {
+		broken := &brokenSearcher{}
+		api := NewByDimensionApiWithSearcher("unittest-index", broken)
+		api.Retry = &RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+		_, err := api.retryingSearch(context.Background(), api.Index, "?search_type=count", "{}")
+		Expect(err).To(HaveOccurred())
+		Expect(broken.calls).To(Equal(3)) // initial attempt + 2 retries
+	})
+
+	It("should abort promptly when the context is cancelled", func() {
+		slow := &slowSearcher{}
+		api := NewByDimensionApiWithSearcher("unittest-index", slow)
+		api.Retry = &RetryPolicy{MaxRetries: 5, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := api.retryingSearch(ctx, api.Index, "?search_type=count", "{}")
+		Expect(err).To(Equal(context.Canceled))
+		Expect(slow.calls).To(Equal(1))
+	})
+})
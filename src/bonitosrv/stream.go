@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bonitosrv/esversion"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// compositePageSize caps how many primary-dimension buckets are requested
+// per composite aggregation page.
+const compositePageSize = 1000
+
+// EsCompositeByDimensionReq mirrors EsByDimensionReq but walks the primary
+// dimension with a `composite` aggregation instead of `terms`, so primary
+// dimensions with more members than the default terms `size` cap can be
+// paged through with `after_key` instead of being silently truncated.
+type EsCompositeByDimensionReq struct {
+	Query *MapStr `json:"query,omitempty"`
+	Size  *int    `json:"size,omitempty"`
+	Aggs  struct {
+		Primary struct {
+			Composite MapStr `json:"composite"`
+			Aggs      MapStr `json:"aggs"`
+		} `json:"primary"`
+	} `json:"aggs"`
+}
+
+// StreamQuery behaves like Query, but writes one newline-delimited JSON
+// PrimaryDimension to w as soon as its bucket is decoded, instead of
+// accumulating the whole ByDimensionResponse in memory. It pages through
+// the primary dimension with a composite aggregation, so tenants with
+// thousands of services aren't capped by the default terms `size`. ctx is
+// checked between pages and passed down to each search, so a disconnected
+// or cancelled caller stops the walk instead of paging through every
+// remaining composite page.
+func (api *ByDimensionApi) StreamQuery(ctx context.Context, req *ByDimensionRequest, w io.Writer) error {
+	api.setRequestDefaults(req)
+
+	v, err := api.ensureVersion()
+	if err != nil {
+		return err
+	}
+
+	if !esversion.SupportsComposite(v) {
+		return fmt.Errorf("esversion: StreamQuery requires composite aggregation support, not available on this Elasticsearch version")
+	}
+
+	metricAggs, err := api.buildRequestAggs(req)
+	if err != nil {
+		return err
+	}
+
+	histAggs, err := api.buildRequestHistogramAggs(req)
+	if err != nil {
+		return err
+	}
+	for k, agg := range *histAggs {
+		(*metricAggs)[k] = agg
+	}
+
+	enc := json.NewEncoder(w)
+
+	var after MapStr
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var esreq EsCompositeByDimensionReq
+		if esversion.NeedsSizeZero(v) {
+			zero := 0
+			esreq.Size = &zero
+		}
+
+		composite := MapStr{
+			"size": compositePageSize,
+			"sources": []MapStr{
+				{
+					req.Config.Primary_dimension: MapStr{
+						"terms": MapStr{"field": req.Config.Primary_dimension},
+					},
+				},
+			},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+		esreq.Aggs.Primary.Composite = composite
+		esreq.Aggs.Primary.Aggs = *metricAggs
+
+		objreq, err := json.Marshal(&esreq)
+		if err != nil {
+			return err
+		}
+
+		body, _, err := api.doSearchRaw(ctx, string(objreq))
+		if err != nil {
+			return err
+		}
+
+		var answ struct {
+			Aggregations struct {
+				Primary struct {
+					Buckets  []map[string]json.RawMessage
+					AfterKey map[string]json.RawMessage `json:"after_key"`
+				}
+			}
+		}
+		if err := json.Unmarshal(body, &answ); err != nil {
+			return err
+		}
+
+		for _, bucket := range answ.Aggregations.Primary.Buckets {
+			var key map[string]json.RawMessage
+			if err := json.Unmarshal(bucket["key"], &key); err != nil {
+				return err
+			}
+
+			name, ok := key[req.Config.Primary_dimension]
+			if !ok {
+				continue
+			}
+			bucket["key"] = name
+
+			primary, err := api.bucketToPrimary(req, bucket)
+			if err != nil {
+				return err
+			}
+
+			if err := enc.Encode(primary); err != nil {
+				return err
+			}
+		}
+
+		if len(answ.Aggregations.Primary.AfterKey) == 0 ||
+			len(answ.Aggregations.Primary.Buckets) == 0 {
+			return nil
+		}
+
+		afterKeyJSON, err := json.Marshal(answ.Aggregations.Primary.AfterKey)
+		if err != nil {
+			return err
+		}
+
+		var afterVals map[string]interface{}
+		if err := json.Unmarshal(afterKeyJSON, &afterVals); err != nil {
+			return err
+		}
+		after = MapStr(afterVals)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// pagedSearcher serves a fixed sequence of composite-aggregation pages,
+// one per Search call, so StreamQuery's after_key pagination can be
+// exercised without a live ES.
+type pagedSearcher struct {
+	pages   []string
+	version string
+	calls   int
+}
+
+func (p *pagedSearcher) Search(ctx context.Context, index, query, body string) (*http.Response, error) {
+	page := p.pages[p.calls]
+	p.calls++
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(page)),
+	}, nil
+}
+
+func (p *pagedSearcher) MultiSearch(ctx context.Context, index, body string) (*http.Response, error) {
+	return nil, nil
+}
+
+func (p *pagedSearcher) Ping() (*http.Response, error) {
+	version := p.version
+	if version == "" {
+		version = "6.8.1"
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"version":{"number":"` + version + `"}}`)),
+	}, nil
+}
+
+var _ = Describe("StreamQuery", func() {
+	It("should walk composite pages and emit one NDJSON object per primary dimension", func() {
+		fake := &pagedSearcher{pages: []string{
+			`{"aggregations":{"primary":{
+				"buckets": [{"key": {"service": "service1"}, "volume": {"value": 5}}],
+				"after_key": {"service": "service1"}
+			}}}`,
+			`{"aggregations":{"primary":{
+				"buckets": [{"key": {"service": "service2"}, "volume": {"value": 7}}]
+			}}}`,
+		}}
+
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+
+		req := &ByDimensionRequest{Metrics: []string{"volume"}}
+
+		var out bytes.Buffer
+		err := api.StreamQuery(context.Background(), req, &out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.calls).To(Equal(2))
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+
+		var first, second PrimaryDimension
+		Expect(json.Unmarshal([]byte(lines[0]), &first)).To(Succeed())
+		Expect(json.Unmarshal([]byte(lines[1]), &second)).To(Succeed())
+
+		Expect(first.Name).To(Equal("service1"))
+		Expect(first.Metrics["volume"]).To(BeNumerically("~", 5))
+		Expect(second.Name).To(Equal("service2"))
+		Expect(second.Metrics["volume"]).To(BeNumerically("~", 7))
+	})
+
+	It("should refuse to stream against a version without composite aggregation support", func() {
+		fake := &pagedSearcher{version: "2.4.0"}
+
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+		req := &ByDimensionRequest{Metrics: []string{"volume"}}
+
+		var out bytes.Buffer
+		err := api.StreamQuery(context.Background(), req, &out)
+		Expect(err).To(HaveOccurred())
+		Expect(fake.calls).To(Equal(0))
+		Expect(out.String()).To(BeEmpty())
+	})
+
+	It("should stop paging once the context is cancelled", func() {
+		fake := &pagedSearcher{pages: []string{
+			`{"aggregations":{"primary":{
+				"buckets": [{"key": {"service": "service1"}, "volume": {"value": 5}}],
+				"after_key": {"service": "service1"}
+			}}}`,
+			`{"aggregations":{"primary":{
+				"buckets": [{"key": {"service": "service2"}, "volume": {"value": 7}}]
+			}}}`,
+		}}
+
+		api := NewByDimensionApiWithSearcher("unittest-index", fake)
+		req := &ByDimensionRequest{Metrics: []string{"volume"}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var out bytes.Buffer
+		err := api.StreamQuery(ctx, req, &out)
+		Expect(err).To(Equal(context.Canceled))
+		Expect(fake.calls).To(Equal(0))
+	})
+})